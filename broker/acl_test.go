@@ -0,0 +1,26 @@
+package broker
+
+import "testing"
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b/d", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/x/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true}, // "#" also matches the parent level, per spec
+		{"#", "a/b/c", true},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+	}
+
+	for _, c := range cases {
+		if got := topicMatches(c.filter, c.topic); got != c.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+}
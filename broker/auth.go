@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+	"github.com/funkygao/mhub/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errUnknownAuthBackend = errors.New("broker: unknown auth backend")
+
+// AuthProvider decides whether a CONNECT's credentials are valid. It
+// replaces the single hard-coded check that used to live in doConnect,
+// so auth backends can be swapped per deployment via config.Broker.Auth.
+type AuthProvider interface {
+	Authenticate(username, password string) bool
+}
+
+// ACLProvider decides whether an already-authenticated client may
+// publish or subscribe to a given topic. Consulted from doPublish and
+// doSubscribe before touching server.subs.
+type ACLProvider interface {
+	CanPublish(clientId, topic string) bool
+	CanSubscribe(clientId, topic string) bool
+}
+
+// allowAllACL is the default when no ACL backend is configured: every
+// authenticated client may publish/subscribe anywhere.
+type allowAllACL struct{}
+
+func (allowAllACL) CanPublish(clientId, topic string) bool   { return true }
+func (allowAllACL) CanSubscribe(clientId, topic string) bool { return true }
+
+// newAuthProvider builds the configured AuthProvider. An empty Backend
+// keeps the previous "anonymous unless AllowAnonymousConnect is false"
+// behaviour.
+func newAuthProvider(cf config.AuthConfig) (AuthProvider, error) {
+	switch cf.Backend {
+	case "", config.AuthBackendNone:
+		return nil, nil
+
+	case config.AuthBackendFile:
+		return newFileAuthProvider(cf.File)
+
+	case config.AuthBackendJWT:
+		return &jwtAuthProvider{secret: []byte(cf.JWTSecret)}, nil
+
+	case config.AuthBackendHTTP:
+		return &httpAuthProvider{url: cf.HTTPURL, client: &http.Client{Timeout: 3 * time.Second}}, nil
+	}
+
+	return nil, errUnknownAuthBackend
+}
+
+// fileAuthProvider checks "username:bcryptHash" lines loaded from disk,
+// reloadable on SIGHUP without a broker restart.
+type fileAuthProvider struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string][]byte // username -> bcrypt hash
+}
+
+func newFileAuthProvider(path string) (*fileAuthProvider, error) {
+	p := &fileAuthProvider{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (this *fileAuthProvider) reload() error {
+	f, err := os.Open(this.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			log.Warn("auth file %s: malformed line %q", this.path, line)
+			continue
+		}
+
+		users[parts[0]] = []byte(parts[1])
+	}
+
+	this.mu.Lock()
+	this.users = users
+	this.mu.Unlock()
+
+	log.Info("auth file %s: loaded %d users", this.path, len(users))
+	return scanner.Err()
+}
+
+func (this *fileAuthProvider) Authenticate(username, password string) bool {
+	this.mu.RLock()
+	hash, present := this.users[username]
+	this.mu.RUnlock()
+
+	if !present {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// jwtAuthProvider treats the CONNECT password field as a bearer JWT,
+// valid when it verifies against secret, has not expired, and its "sub"
+// claim equals the CONNECT username.
+type jwtAuthProvider struct {
+	secret []byte
+}
+
+func (this *jwtAuthProvider) Authenticate(username, password string) bool {
+	claims, err := parseAndVerifyJWT(password, this.secret)
+	if err != nil {
+		log.Debug("jwt auth for %s: %s", username, err)
+		return false
+	}
+
+	return claims.Subject == username
+}
+
+// httpAuthProvider delegates the connect decision to an external HTTP
+// endpoint, POSTed the username/password as JSON; any 2xx response is
+// treated as authorized.
+type httpAuthProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (this *httpAuthProvider) Authenticate(username, password string) bool {
+	body, _ := json.Marshal(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{username, password})
+
+	resp, err := this.client.Post(this.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("http auth %s: %s", this.url, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
@@ -0,0 +1,226 @@
+package broker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/funkygao/log4go"
+	"github.com/funkygao/mhub/config"
+	"github.com/hashicorp/memberlist"
+)
+
+// cluster turns a single broker into one node of a mesh: memberlist
+// handles gossip-based membership/health, a consistent-hash ring decides
+// which nodes own a topic's subscribers (Peers.ReplicationFactor of
+// them), and clusterState (backed by raft) replicates retained messages
+// so every node in the mesh converges on the same value for a topic.
+//
+// A disabled cluster (Peers.BindAddr == "") degrades to the pre-existing
+// isGlobalTopic broadcast-to-everyone behaviour.
+type cluster struct {
+	selfId            string
+	list              *memberlist.Memberlist
+	ring              *hashRing
+	state             *clusterState
+	retain            RetainStore // raft-replicated retained messages; see clusterstate.go
+	replicationFactor int
+
+	mu    sync.RWMutex
+	nodes map[string]bool // nodeId -> alive
+}
+
+func newCluster(cf *config.Config) (*cluster, error) {
+	if cf.Peers.BindAddr == "" {
+		return nil, nil
+	}
+
+	replicationFactor := cf.Peers.ReplicationFactor
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+
+	c := &cluster{
+		selfId: cf.Peers.SelfId,
+		// the ring's virtual-node count controls routing balance and is
+		// unrelated to how many nodes a topic is replicated to, so it is
+		// not derived from ReplicationFactor.
+		ring:              newHashRing(cf.Peers.VirtualNodes),
+		replicationFactor: replicationFactor,
+		nodes:             make(map[string]bool),
+	}
+
+	mc := memberlist.DefaultLANConfig()
+	mc.Name = c.selfId
+	mc.BindAddr = cf.Peers.BindAddr
+	mc.BindPort = cf.Peers.BindPort
+	mc.AdvertiseAddr = cf.Peers.AdvertiseAddr
+	mc.Events = &clusterEventDelegate{c: c}
+
+	list, err := memberlist.Create(mc)
+	if err != nil {
+		return nil, err
+	}
+	c.list = list
+
+	if len(cf.Peers.Seeds) > 0 {
+		if _, err := list.Join(cf.Peers.Seeds); err != nil {
+			log.Error("cluster join seeds %v: %s", cf.Peers.Seeds, err)
+		}
+	}
+
+	c.ring.add(c.selfId)
+
+	state, err := newClusterState(cf.Peers.RaftDir, c.selfId, cf.Peers.Seeds)
+	if err != nil {
+		return nil, err
+	}
+	c.state = state
+	c.retain = &clusterRetainStore{state: state}
+
+	return c, nil
+}
+
+// route decides which nodes own the subscribers of topic, up to
+// replicationFactor of them. local is true when this node is one of
+// them and should deliver directly; the caller forwards to the rest
+// across the mesh.
+func (this *cluster) route(topic string) (nodeIds []string, local bool) {
+	if this == nil {
+		return nil, true
+	}
+
+	// a topic name containing a wildcard is not routed on the ring: it
+	// is delivered to local subscribers only and forwarded to no peer.
+	if isWildcard(topic) {
+		return nil, true
+	}
+
+	nodeIds = this.ring.getN(topic, this.replicationFactor)
+	for _, id := range nodeIds {
+		if id == this.selfId {
+			local = true
+			break
+		}
+	}
+	return nodeIds, local
+}
+
+func (this *cluster) memberJoined(nodeId string) {
+	this.mu.Lock()
+	this.nodes[nodeId] = true
+	this.mu.Unlock()
+
+	this.ring.add(nodeId)
+	log.Info("cluster: %s joined, ring has %d nodes", nodeId, this.ring.size())
+}
+
+func (this *cluster) memberLeft(nodeId string) {
+	this.mu.Lock()
+	delete(this.nodes, nodeId)
+	this.mu.Unlock()
+
+	this.ring.remove(nodeId)
+	log.Info("cluster: %s left, ring has %d nodes", nodeId, this.ring.size())
+}
+
+// clusterEventDelegate adapts memberlist's callback API to cluster's
+// join/leave re-balancing.
+type clusterEventDelegate struct {
+	c *cluster
+}
+
+func (this *clusterEventDelegate) NotifyJoin(n *memberlist.Node) {
+	this.c.memberJoined(n.Name)
+}
+
+func (this *clusterEventDelegate) NotifyLeave(n *memberlist.Node) {
+	this.c.memberLeft(n.Name)
+}
+
+func (this *clusterEventDelegate) NotifyUpdate(n *memberlist.Node) {}
+
+// hashRing is a consistent-hash ring over node ids, replicated vnodes
+// apart, used to pick a deterministic owner node for a topic so routing
+// decisions stay stable as nodes join and leave.
+type hashRing struct {
+	mu     sync.RWMutex
+	vnodes int
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(vnodes int) *hashRing {
+	if vnodes <= 0 {
+		vnodes = 128
+	}
+	return &hashRing{vnodes: vnodes, owners: make(map[uint32]string)}
+}
+
+func (this *hashRing) add(nodeId string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i := 0; i < this.vnodes; i++ {
+		h := ringHash(fmt.Sprintf("%s#%d", nodeId, i))
+		this.owners[h] = nodeId
+		this.hashes = append(this.hashes, h)
+	}
+	sort.Slice(this.hashes, func(i, j int) bool { return this.hashes[i] < this.hashes[j] })
+}
+
+func (this *hashRing) remove(nodeId string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	kept := this.hashes[:0]
+	for _, h := range this.hashes {
+		if this.owners[h] == nodeId {
+			delete(this.owners, h)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	this.hashes = kept
+}
+
+// getN returns up to n distinct node ids owning key, walking the ring
+// clockwise from key's hash. Replication lives here: the caller decides
+// what "own" means (deliver locally, forward remotely, ...), getN just
+// names which n nodes agree on it.
+func (this *hashRing) getN(key string, n int) []string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if len(this.hashes) == 0 || n <= 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(this.hashes), func(i int) bool { return this.hashes[i] >= h })
+
+	seen := make(map[string]bool, n)
+	var owners []string
+	for i := 0; i < len(this.hashes) && len(owners) < n; i++ {
+		nodeId := this.owners[this.hashes[(start+i)%len(this.hashes)]]
+		if seen[nodeId] {
+			continue
+		}
+		seen[nodeId] = true
+		owners = append(owners, nodeId)
+	}
+	return owners
+}
+
+func (this *hashRing) size() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.hashes) / this.vnodes
+}
+
+func ringHash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
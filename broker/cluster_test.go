@@ -0,0 +1,53 @@
+package broker
+
+import "testing"
+
+func TestHashRingGetNDistinctOwners(t *testing.T) {
+	ring := newHashRing(64)
+	for _, id := range []string{"node1", "node2", "node3"} {
+		ring.add(id)
+	}
+
+	owners := ring.getN("some/topic", 2)
+	if len(owners) != 2 {
+		t.Fatalf("getN(2) returned %d owners, want 2: %v", len(owners), owners)
+	}
+	if owners[0] == owners[1] {
+		t.Fatalf("getN(2) returned duplicate owner %q", owners[0])
+	}
+}
+
+func TestHashRingGetNStableForSameKey(t *testing.T) {
+	ring := newHashRing(64)
+	for _, id := range []string{"node1", "node2", "node3"} {
+		ring.add(id)
+	}
+
+	first := ring.getN("some/topic", 1)
+	second := ring.getN("some/topic", 1)
+	if len(first) != 1 || len(second) != 1 || first[0] != second[0] {
+		t.Fatalf("getN(1) not stable across calls: %v vs %v", first, second)
+	}
+}
+
+func TestHashRingGetNCapsAtRingSize(t *testing.T) {
+	ring := newHashRing(8)
+	ring.add("node1")
+
+	if owners := ring.getN("some/topic", 3); len(owners) != 1 {
+		t.Fatalf("getN(3) on a 1-node ring returned %v, want exactly 1 owner", owners)
+	}
+}
+
+func TestHashRingRemove(t *testing.T) {
+	ring := newHashRing(32)
+	ring.add("node1")
+	ring.add("node2")
+	ring.remove("node1")
+
+	for _, owner := range ring.getN("some/topic", 2) {
+		if owner == "node1" {
+			t.Fatalf("getN returned removed node %q", owner)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+	proto "github.com/funkygao/mqttmsg"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// clusterState replicates retained messages via raft so every node in
+// the mesh converges on the same retained value for a topic, instead of
+// each node holding its own independent copy. Session ownership and ACL
+// rules are not (yet) part of this: sessions live wherever a client's
+// CleanSession=false connection happens to land, and ACL rules are
+// loaded independently per node from fileACL/config.
+type clusterState struct {
+	raft *raft.Raft
+	fsm  *clusterFSM
+}
+
+func newClusterState(dataDir, selfId string, seeds []string) (*clusterState, error) {
+	fsm := newClusterFSM()
+
+	store, err := raftboltdb.NewBoltStore(dataDir + "/raft.db")
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(dataDir, 2, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := raft.NewTCPTransport(selfId, nil, 3, 10*time.Second, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(selfId)
+
+	r, err := raft.NewRaft(rc, fsm, store, store, snaps, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(seeds) == 0 {
+		// first node of a fresh cluster bootstraps itself as the only voter
+		r.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}},
+		})
+	}
+
+	return &clusterState{raft: r, fsm: fsm}, nil
+}
+
+func (this *clusterState) setRetained(topic string, payload []byte) error {
+	return this.apply(stateOp{Op: opSetRetained, Topic: topic, Payload: payload})
+}
+
+func (this *clusterState) deleteRetained(topic string) error {
+	return this.apply(stateOp{Op: opDeleteRetained, Topic: topic})
+}
+
+func (this *clusterState) retained(topic string) ([]byte, bool) {
+	return this.fsm.lookupRetained(topic)
+}
+
+func (this *clusterState) match(filter string) []*proto.Publish {
+	return this.fsm.match(filter)
+}
+
+// clusterRetainStore adapts clusterState to the RetainStore interface
+// (retain.go) so deliver() can hold retained messages in raft rather
+// than in a node-local memRetainStore/boltRetainStore when clustered.
+type clusterRetainStore struct {
+	state *clusterState
+}
+
+func (this *clusterRetainStore) Set(m *proto.Publish) error {
+	buf, err := encodeRetained(m)
+	if err != nil {
+		return err
+	}
+	return this.state.setRetained(m.TopicName, buf)
+}
+
+func (this *clusterRetainStore) Delete(topic string) error {
+	return this.state.deleteRetained(topic)
+}
+
+func (this *clusterRetainStore) Match(filter string) []*proto.Publish {
+	return this.state.match(filter)
+}
+
+func (this *clusterRetainStore) Close() {}
+
+func (this *clusterState) apply(op stateOp) error {
+	if this.raft.State() != raft.Leader {
+		// only the leader may write; followers would need to forward to
+		// the leader over the transport, left for the replication layer.
+		log.Debug("clusterState: apply on non-leader, dropped: %+v", op)
+		return raft.ErrNotLeader
+	}
+
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	return this.raft.Apply(b, 5*time.Second).Error()
+}
+
+const (
+	opSetRetained    = "set_retained"
+	opDeleteRetained = "delete_retained"
+)
+
+type stateOp struct {
+	Op      string
+	Topic   string
+	Payload []byte
+}
+
+// clusterFSM applies replicated stateOps to build the in-memory view of
+// retained messages every node converges on.
+type clusterFSM struct {
+	mu       sync.RWMutex
+	retained map[string][]byte
+}
+
+func newClusterFSM() *clusterFSM {
+	return &clusterFSM{retained: make(map[string][]byte)}
+}
+
+func (this *clusterFSM) Apply(entry *raft.Log) interface{} {
+	var op stateOp
+	if err := json.Unmarshal(entry.Data, &op); err != nil {
+		log.Error("clusterFSM: bad log entry: %s", err)
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	switch op.Op {
+	case opSetRetained:
+		this.retained[op.Topic] = op.Payload
+	case opDeleteRetained:
+		delete(this.retained, op.Topic)
+	}
+	return nil
+}
+
+func (this *clusterFSM) lookupRetained(topic string) ([]byte, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	p, present := this.retained[topic]
+	return p, present
+}
+
+func (this *clusterFSM) match(filter string) []*proto.Publish {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var r []*proto.Publish
+	for topic, buf := range this.retained {
+		if !topicMatches(filter, topic) {
+			continue
+		}
+
+		m, err := decodeRetained(buf)
+		if err != nil {
+			log.Error("clusterFSM: decode retained %q: %s", topic, err)
+			continue
+		}
+		r = append(r, m)
+	}
+	return r
+}
+
+func (this *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	snap := make(map[string][]byte, len(this.retained))
+	for k, v := range this.retained {
+		snap[k] = v
+	}
+	return &clusterFSMSnapshot{retained: snap}, nil
+}
+
+func (this *clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var retained map[string][]byte
+	if err := json.NewDecoder(rc).Decode(&retained); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	this.retained = retained
+	this.mu.Unlock()
+	return nil
+}
+
+type clusterFSMSnapshot struct {
+	retained map[string][]byte
+}
+
+func (this *clusterFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := json.NewEncoder(sink).Encode(this.retained)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (this *clusterFSMSnapshot) Release() {}
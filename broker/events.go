@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+	"github.com/gorilla/websocket"
+)
+
+// eventSubBufSize bounds how far a single /events subscriber may lag
+// behind before emit starts dropping events for it.
+const eventSubBufSize = 32
+
+// eventWriteTimeout bounds how long a single write to a /events
+// subscriber may take before it is considered stalled.
+const eventWriteTimeout = 5 * time.Second
+
+// clientEvent is one connect/disconnect/publish occurrence, streamed as
+// JSON over WebSocket to whoever is watching /events. It exists purely
+// for interactively debugging fan-out problems; it is not durable and
+// carries no delivery guarantee.
+type clientEvent struct {
+	Type     string `json:"type"` // "connect", "disconnect", "publish"
+	ClientId string `json:"client_id"`
+	Topic    string `json:"topic,omitempty"`
+	QoS      uint8  `json:"qos,omitempty"`
+}
+
+// eventStream fans clientEvents out to every connected /events websocket.
+// publish events are sampled since they can be far higher volume than
+// connects/disconnects; connect/disconnect are always sent. Each
+// subscriber gets its own buffered channel and writer goroutine, so a
+// slow or stalled /events client only ever drops its own events instead
+// of blocking emit (and, through it, the connect/disconnect/publish hot
+// paths in session.go that call it).
+type eventStream struct {
+	sampleRate float64 // fraction of publish events to emit, e.g. 0.01
+
+	mu   sync.Mutex
+	subs map[*websocket.Conn]chan []byte
+}
+
+func newEventStream(sampleRate float64) *eventStream {
+	return &eventStream{sampleRate: sampleRate, subs: make(map[*websocket.Conn]chan []byte)}
+}
+
+var eventUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (this *eventStream) serveWS(w http.ResponseWriter, r *http.Request) {
+	c, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("events ws upgrade: %s", err)
+		return
+	}
+
+	out := make(chan []byte, eventSubBufSize)
+	this.mu.Lock()
+	this.subs[c] = out
+	this.mu.Unlock()
+
+	go this.writeLoop(c, out)
+
+	// the client never sends anything meaningful; block on reads just to
+	// notice when it goes away so it can be removed from subs.
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			this.remove(c)
+			c.Close()
+			return
+		}
+	}
+}
+
+// writeLoop drains a single subscriber's buffered channel so emit never
+// has to wait on that subscriber's socket.
+func (this *eventStream) writeLoop(c *websocket.Conn, out chan []byte) {
+	for buf := range out {
+		c.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if err := c.WriteMessage(websocket.TextMessage, buf); err != nil {
+			this.remove(c)
+			c.Close()
+			return
+		}
+	}
+}
+
+func (this *eventStream) remove(c *websocket.Conn) {
+	this.mu.Lock()
+	if out, present := this.subs[c]; present {
+		delete(this.subs, c)
+		close(out)
+	}
+	this.mu.Unlock()
+}
+
+func (this *eventStream) emit(e clientEvent) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for c, out := range this.subs {
+		select {
+		case out <- buf:
+		default:
+			// subscriber is falling behind; drop rather than block every
+			// other caller of emit.
+			log.Warn("events: dropping event for slow /events subscriber %s", c.RemoteAddr())
+		}
+	}
+}
+
+func (this *eventStream) connected(clientId string) {
+	this.emit(clientEvent{Type: "connect", ClientId: clientId})
+}
+
+func (this *eventStream) disconnected(clientId string) {
+	this.emit(clientEvent{Type: "disconnect", ClientId: clientId})
+}
+
+func (this *eventStream) published(clientId, topic string, qos uint8) {
+	if this.sampleRate < 1 && rand.Float64() > this.sampleRate {
+		return
+	}
+	this.emit(clientEvent{Type: "publish", ClientId: clientId, Topic: topic, QoS: qos})
+}
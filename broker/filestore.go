@@ -0,0 +1,323 @@
+package broker
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+	"github.com/funkygao/mhub/config"
+	proto "github.com/funkygao/mqttmsg"
+)
+
+func sortByName(entries []os.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
+
+// fileStore is a durable Store backend modelled on Paho's FileStore: each
+// piece of per-client state is its own file under <dir>/<clientId>/...,
+// so a crash loses at most the entry currently being written.
+type fileStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newFileStore(dir string) *fileStore {
+	return &fileStore{dir: dir}
+}
+
+func (this *fileStore) Close() {}
+
+func (this *fileStore) clientDir(clientId string) string {
+	return filepath.Join(this.dir, clientId)
+}
+
+func (this *fileStore) inflightDir(clientId string) string {
+	return filepath.Join(this.clientDir(clientId), "inflight")
+}
+
+func (this *fileStore) msgPath(clientId string, messageId uint16) string {
+	return filepath.Join(this.inflightDir(clientId), strconv.Itoa(int(messageId)))
+}
+
+func (this *fileStore) offlineDir(clientId string) string {
+	return filepath.Join(this.clientDir(clientId), "offline")
+}
+
+func (this *fileStore) subsPath(clientId string) string {
+	return filepath.Join(this.clientDir(clientId), "subs")
+}
+
+func (this *fileStore) lastSeenPath(clientId string) string {
+	return filepath.Join(this.clientDir(clientId), "lastseen")
+}
+
+func (this *fileStore) SaveInflight(clientId string, m *proto.Publish) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := os.MkdirAll(this.inflightDir(clientId), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.Create(this.msgPath(clientId, m.MessageId))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewEncoder(f).Encode(m)
+}
+
+func (this *fileStore) RemoveInflight(clientId string, messageId uint16) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	err := os.Remove(this.msgPath(clientId, messageId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (this *fileStore) LoadInflight(clientId string) ([]*proto.Publish, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.loadPublishes(this.inflightDir(clientId))
+}
+
+func (this *fileStore) loadPublishes(dir string) ([]*proto.Publish, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	r := make([]*proto.Publish, 0, len(entries))
+	for _, ent := range entries {
+		path := filepath.Join(dir, ent.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			log.Error("open %s: %s", path, err)
+			continue
+		}
+
+		var m proto.Publish
+		err = gob.NewDecoder(f).Decode(&m)
+		f.Close()
+		if err != nil {
+			log.Error("decode %s: %s", path, err)
+			continue
+		}
+
+		r = append(r, &m)
+	}
+	return r, nil
+}
+
+func (this *fileStore) SaveSubscription(clientId, topic string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	topics, err := this.readSubs(clientId)
+	if err != nil {
+		return err
+	}
+	topics[topic] = true
+	return this.writeSubs(clientId, topics)
+}
+
+func (this *fileStore) RemoveSubscription(clientId, topic string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	topics, err := this.readSubs(clientId)
+	if err != nil {
+		return err
+	}
+	delete(topics, topic)
+	return this.writeSubs(clientId, topics)
+}
+
+func (this *fileStore) LoadSubscriptions(clientId string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	topics, err := this.readSubs(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]string, 0, len(topics))
+	for t := range topics {
+		r = append(r, t)
+	}
+	return r, nil
+}
+
+func (this *fileStore) readSubs(clientId string) (map[string]bool, error) {
+	f, err := os.Open(this.subsPath(clientId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make(map[string]bool), nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	topics := make(map[string]bool)
+	err = gob.NewDecoder(f).Decode(&topics)
+	if err != nil {
+		return make(map[string]bool), nil
+	}
+	return topics, nil
+}
+
+func (this *fileStore) writeSubs(clientId string, topics map[string]bool) error {
+	if err := os.MkdirAll(this.clientDir(clientId), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.Create(this.subsPath(clientId))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewEncoder(f).Encode(topics)
+}
+
+func (this *fileStore) MatchSubscribers(topic string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var r []string
+	for _, ent := range entries {
+		if !ent.IsDir() {
+			continue
+		}
+
+		clientId := ent.Name()
+		topics, err := this.readSubs(clientId)
+		if err != nil {
+			continue
+		}
+
+		for filter := range topics {
+			if topicMatches(filter, topic) {
+				r = append(r, clientId)
+				break
+			}
+		}
+	}
+	return r, nil
+}
+
+func (this *fileStore) EnqueueOffline(clientId string, m *proto.Publish, maxSize int, overflow config.BufferOverflowStrategy) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	dir := this.offlineDir(clientId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if maxSize > 0 && len(entries) >= maxSize {
+		if overflow != config.BufferOverflowDiscard {
+			return errOfflineQueueFull
+		}
+
+		// drop the oldest (lexicographically smallest sequence file) to
+		// make room for m
+		sortByName(entries)
+		os.Remove(filepath.Join(dir, entries[0].Name()))
+	}
+
+	f, err := os.Create(filepath.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewEncoder(f).Encode(m)
+}
+
+func (this *fileStore) DrainOffline(clientId string) ([]*proto.Publish, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	dir := this.offlineDir(clientId)
+	r, err := this.loadPublishes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	os.RemoveAll(dir)
+	return r, nil
+}
+
+func (this *fileStore) Touch(clientId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := os.MkdirAll(this.clientDir(clientId), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(this.lastSeenPath(clientId), []byte(strconv.FormatInt(time.Now().Unix(), 10)), 0600)
+}
+
+func (this *fileStore) ExpireSessions(ttl time.Duration) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var expired []string
+	cutoff := time.Now().Add(-ttl).Unix()
+	for _, ent := range entries {
+		if !ent.IsDir() {
+			continue
+		}
+
+		clientId := ent.Name()
+		buf, err := os.ReadFile(this.lastSeenPath(clientId))
+		if err != nil {
+			continue
+		}
+
+		seen, err := strconv.ParseInt(string(buf), 10, 64)
+		if err != nil || seen >= cutoff {
+			continue
+		}
+
+		expired = append(expired, clientId)
+		os.RemoveAll(this.clientDir(clientId))
+	}
+	return expired, nil
+}
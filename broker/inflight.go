@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/funkygao/log4go"
+	proto "github.com/funkygao/mqttmsg"
+)
+
+// inflightDirection records which half of a QoS handshake a tracked
+// message is waiting on.
+type inflightDirection int
+
+const (
+	// inflightOutbound is a PUBLISH this session sent that is waiting on
+	// PUBACK (QoS 1) or PUBREC/PUBCOMP (QoS 2) from the peer.
+	inflightOutbound inflightDirection = iota
+
+	// inflightInbound is a QoS 2 PUBLISH this session received that is
+	// waiting on PUBREL before it may be forwarded to subscribers.
+	inflightInbound
+)
+
+// inflightMessage is a single QoS>=1 message that has not yet completed
+// its acknowledgement handshake.
+type inflightMessage struct {
+	msg       *proto.Publish
+	dir       inflightDirection
+	awaitComp bool // QoS 2 only: PUBREC sent/received, now waiting on PUBREL/PUBCOMP
+	sentAt    time.Time
+	retries   int
+}
+
+// inflightTable is the per-session window of unacknowledged messages,
+// indexed by MessageId. Redelivery and dedup both key off of it.
+type inflightTable struct {
+	mu       sync.Mutex
+	messages map[uint16]*inflightMessage
+}
+
+func newInflightTable() *inflightTable {
+	return &inflightTable{messages: make(map[uint16]*inflightMessage)}
+}
+
+func (t *inflightTable) add(m *proto.Publish, dir inflightDirection) {
+	t.mu.Lock()
+	t.messages[m.MessageId] = &inflightMessage{msg: m, dir: dir, sentAt: time.Now()}
+	t.mu.Unlock()
+	inflightDepth.Inc()
+}
+
+func (t *inflightTable) get(id uint16) (*inflightMessage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	im, present := t.messages[id]
+	return im, present
+}
+
+func (t *inflightTable) markAwaitComp(id uint16) {
+	t.mu.Lock()
+	if im, present := t.messages[id]; present {
+		im.awaitComp = true
+		im.sentAt = time.Now()
+		im.retries = 0
+	}
+	t.mu.Unlock()
+}
+
+func (t *inflightTable) remove(id uint16) {
+	t.mu.Lock()
+	_, present := t.messages[id]
+	delete(t.messages, id)
+	t.mu.Unlock()
+
+	if present {
+		inflightDepth.Dec()
+	}
+}
+
+func (t *inflightTable) snapshot() []*inflightMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := make([]*inflightMessage, 0, len(t.messages))
+	for _, im := range t.messages {
+		r = append(r, im)
+	}
+	return r
+}
+
+func (t *inflightTable) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.messages)
+}
+
+// retryLoop periodically redelivers outbound messages that have been
+// sitting in the in-flight window longer than InflightRetryInterval,
+// setting the DUP flag, until InflightMaxRetries is exceeded.
+func (this *incomingConn) retryLoop() {
+	interval := this.server.cf.Broker.InflightRetryInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !this.alive {
+				return
+			}
+
+			for _, im := range this.inflight.snapshot() {
+				if im.dir != inflightOutbound || time.Since(im.sentAt) < interval {
+					continue
+				}
+
+				if im.retries >= this.server.cf.Broker.InflightMaxRetries {
+					log.Warn("%s: giving up redelivery of msg %d after %d retries",
+						this, im.msg.MessageId, im.retries)
+					this.inflight.remove(im.msg.MessageId)
+					this.store.RemoveInflight(this.flag.ClientId, im.msg.MessageId)
+					continue
+				}
+
+				im.retries++
+				im.sentAt = time.Now()
+
+				if im.awaitComp {
+					// QoS 2, already PUBRECed: re-nudge with PUBREL, not the
+					// original PUBLISH, per spec.
+					this.submit(&proto.PubRel{MessageId: im.msg.MessageId})
+					continue
+				}
+
+				dup := *im.msg
+				dup.Header.DupFlag = true
+				this.submit(&dup)
+			}
+
+		case <-this.heartbeatStop:
+			return
+		}
+	}
+}
+
+// redeliverInflight resends everything still outstanding in the durable
+// store for this client, used when a CleanSession=false client reconnects.
+func (this *incomingConn) redeliverInflight() {
+	pending, err := this.store.LoadInflight(this.flag.ClientId)
+	if err != nil {
+		log.Error("%s: load inflight: %s", this, err)
+		return
+	}
+
+	for _, m := range pending {
+		this.inflight.add(m, inflightOutbound)
+
+		dup := *m
+		dup.Header.DupFlag = true
+		this.submit(&dup)
+	}
+}
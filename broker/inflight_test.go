@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"testing"
+
+	proto "github.com/funkygao/mqttmsg"
+)
+
+func TestInflightTableAddGetRemove(t *testing.T) {
+	table := newInflightTable()
+	m := &proto.Publish{MessageId: 1, TopicName: "a/b"}
+
+	table.add(m, inflightOutbound)
+	if got, present := table.get(1); !present || got.msg != m {
+		t.Fatalf("get(1) = %v, %v, want %v, true", got, present, m)
+	}
+	if table.size() != 1 {
+		t.Fatalf("size() = %d, want 1", table.size())
+	}
+
+	table.remove(1)
+	if _, present := table.get(1); present {
+		t.Fatal("get(1) present after remove")
+	}
+	if table.size() != 0 {
+		t.Fatalf("size() = %d, want 0", table.size())
+	}
+}
+
+func TestInflightTableMarkAwaitComp(t *testing.T) {
+	table := newInflightTable()
+	m := &proto.Publish{MessageId: 2, TopicName: "a/b"}
+	table.add(m, inflightInbound)
+
+	table.markAwaitComp(2)
+	im, present := table.get(2)
+	if !present || !im.awaitComp {
+		t.Fatalf("get(2) = %v, %v, want awaitComp=true", im, present)
+	}
+}
+
+func TestInflightTableRemoveUnknownIsNoop(t *testing.T) {
+	table := newInflightTable()
+	table.remove(99) // must not panic
+}
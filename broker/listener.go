@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/funkygao/log4go"
+	"github.com/funkygao/mhub/config"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errUnknownListenerProto = errors.New("broker: unknown listener protocol")
+	errListenerClosed       = errors.New("broker: listener closed")
+)
+
+// Listen starts one net.Listener per entry in cf.Broker.Listeners and
+// accepts connections into incomingConn the same way regardless of
+// transport: incomingConn only ever talks to a net.Conn, so TLS and
+// WebSocket listeners plug in without touching inboundLoop/outboundLoop
+// or the slow-client detection in outboundLoop.
+func (this *Server) Listen(listeners []config.ListenerConfig) error {
+	for _, lc := range listeners {
+		l, err := newNetListener(lc)
+		if err != nil {
+			return err
+		}
+
+		go this.acceptOn(l, lc)
+	}
+
+	return nil
+}
+
+func (this *Server) acceptOn(l net.Listener, lc config.ListenerConfig) {
+	log.Info("listening on %s (%s)", lc.Addr, lc.Proto)
+
+	var active int64 // this listener's own connection count, independent of the others
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error("%s accept: %s", lc.Addr, err)
+			continue
+		}
+
+		if lc.MaxConnections > 0 && atomic.LoadInt64(&active) >= int64(lc.MaxConnections) {
+			log.Warn("listener[%s] at capacity, rejecting %s", lc.Addr, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		atomic.AddInt64(&active, 1)
+
+		// The TLS handshake is a full round-trip with the peer; running it
+		// here would let one stalled client block l.Accept() for everyone
+		// else on this listener, so it happens per-connection instead.
+		go this.handleAccepted(conn, lc, &active)
+	}
+}
+
+// handleAccepted completes the TLS handshake (if any) and hands conn off
+// to inboundLoop/outboundLoop. Called in its own goroutine per connection
+// so a slow or stalled handshake only ever blocks that one connection.
+func (this *Server) handleAccepted(conn net.Conn, lc config.ListenerConfig, active *int64) {
+	ic := &incomingConn{
+		server:  this,
+		alive:   true,
+		conn:    conn,
+		jobs:    make(chan job, this.cf.Broker.QueueSize),
+		store:   this.store,
+		onClose: func() { atomic.AddInt64(active, -1) },
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(this.cf.Broker.IOTimeout))
+		if err := tc.Handshake(); err != nil {
+			log.Error("%s TLS handshake: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			atomic.AddInt64(active, -1)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			ic.peerCert = certs[0]
+		}
+	}
+
+	go ic.inboundLoop()
+	ic.outboundLoop()
+}
+
+func newNetListener(lc config.ListenerConfig) (net.Listener, error) {
+	switch lc.Proto {
+	case config.ListenerTCP, "":
+		return net.Listen("tcp", lc.Addr)
+
+	case config.ListenerTLS:
+		cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tc := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   lc.ALPN,
+		}
+
+		if lc.ClientCAFile != "" {
+			pool := x509.NewCertPool()
+			pem, err := ioutil.ReadFile(lc.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool.AppendCertsFromPEM(pem)
+
+			tc.ClientCAs = pool
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		return tls.Listen("tcp", lc.Addr, tc)
+
+	case config.ListenerWebSocket:
+		return newWebSocketListener(lc)
+	}
+
+	return nil, errUnknownListenerProto
+}
+
+// wsListener accepts MQTT-over-WebSocket (RFC 6455, subprotocol "mqtt")
+// connections and hands each one back through a net.Listener-shaped API
+// so the accept loop above doesn't need to know the difference.
+type wsListener struct {
+	addr     net.Addr
+	accepted chan net.Conn
+	closed   chan struct{}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols:    []string{"mqtt"},
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+func newWebSocketListener(lc config.ListenerConfig) (net.Listener, error) {
+	tcpListener, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{
+		addr:     tcpListener.Addr(),
+		accepted: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		c, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Error("ws upgrade %s: %s", r.RemoteAddr, err)
+			return
+		}
+
+		select {
+		case wl.accepted <- &wsConn{Conn: c}:
+		case <-wl.closed:
+			c.Close()
+		}
+	})
+
+	go http.Serve(tcpListener, mux)
+
+	return wl, nil
+}
+
+func (this *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-this.accepted:
+		return c, nil
+	case <-this.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (this *wsListener) Close() error {
+	close(this.closed)
+	return nil
+}
+
+func (this *wsListener) Addr() net.Addr { return this.addr }
+
+// wsConn adapts a *websocket.Conn's message framing to the byte-stream
+// net.Conn that proto.DecodeOneMessage expects, buffering any leftover
+// bytes from a partially-consumed WebSocket message across Read calls.
+type wsConn struct {
+	*websocket.Conn
+	buf []byte
+}
+
+func (this *wsConn) Read(p []byte) (int, error) {
+	for len(this.buf) == 0 {
+		_, data, err := this.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		this.buf = data
+	}
+
+	n := copy(p, this.buf)
+	this.buf = this.buf[n:]
+	return n, nil
+}
+
+func (this *wsConn) Write(p []byte) (int, error) {
+	if err := this.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (this *wsConn) SetDeadline(t time.Time) error {
+	if err := this.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return this.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/funkygao/mhub/config"
+	proto "github.com/funkygao/mqttmsg"
+)
+
+// memStore is the default Store backend: all state lives only in
+// process memory, so a broker restart loses anything not yet acknowledged
+// or delivered. Use fileStore when that gap is not acceptable.
+type memStore struct {
+	mu       sync.Mutex
+	inflight map[string]map[uint16]*proto.Publish
+	subs     map[string]map[string]bool // clientId -> topic -> subscribed
+	offline  map[string][]*proto.Publish
+	lastSeen map[string]time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		inflight: make(map[string]map[uint16]*proto.Publish),
+		subs:     make(map[string]map[string]bool),
+		offline:  make(map[string][]*proto.Publish),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (this *memStore) Close() {}
+
+func (this *memStore) SaveInflight(clientId string, m *proto.Publish) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	byId, present := this.inflight[clientId]
+	if !present {
+		byId = make(map[uint16]*proto.Publish)
+		this.inflight[clientId] = byId
+	}
+	byId[m.MessageId] = m
+	return nil
+}
+
+func (this *memStore) RemoveInflight(clientId string, messageId uint16) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if byId, present := this.inflight[clientId]; present {
+		delete(byId, messageId)
+	}
+	return nil
+}
+
+func (this *memStore) LoadInflight(clientId string) ([]*proto.Publish, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	byId := this.inflight[clientId]
+	r := make([]*proto.Publish, 0, len(byId))
+	for _, m := range byId {
+		r = append(r, m)
+	}
+	return r, nil
+}
+
+func (this *memStore) SaveSubscription(clientId, topic string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	topics, present := this.subs[clientId]
+	if !present {
+		topics = make(map[string]bool)
+		this.subs[clientId] = topics
+	}
+	topics[topic] = true
+	return nil
+}
+
+func (this *memStore) RemoveSubscription(clientId, topic string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if topics, present := this.subs[clientId]; present {
+		delete(topics, topic)
+	}
+	return nil
+}
+
+func (this *memStore) LoadSubscriptions(clientId string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	topics := this.subs[clientId]
+	r := make([]string, 0, len(topics))
+	for t := range topics {
+		r = append(r, t)
+	}
+	return r, nil
+}
+
+func (this *memStore) MatchSubscribers(topic string) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var r []string
+	for clientId, topics := range this.subs {
+		for filter := range topics {
+			if topicMatches(filter, topic) {
+				r = append(r, clientId)
+				break
+			}
+		}
+	}
+	return r, nil
+}
+
+func (this *memStore) EnqueueOffline(clientId string, m *proto.Publish, maxSize int, overflow config.BufferOverflowStrategy) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	q := this.offline[clientId]
+	if maxSize > 0 && len(q) >= maxSize {
+		if overflow == config.BufferOverflowDiscard {
+			q = q[1:] // drop the oldest to make room for m
+		} else {
+			return errOfflineQueueFull
+		}
+	}
+
+	this.offline[clientId] = append(q, m)
+	return nil
+}
+
+func (this *memStore) DrainOffline(clientId string) ([]*proto.Publish, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	q := this.offline[clientId]
+	delete(this.offline, clientId)
+	return q, nil
+}
+
+func (this *memStore) Touch(clientId string) error {
+	this.mu.Lock()
+	this.lastSeen[clientId] = time.Now()
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *memStore) ExpireSessions(ttl time.Duration) ([]string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var expired []string
+	cutoff := time.Now().Add(-ttl)
+	for clientId, seen := range this.lastSeen {
+		if seen.Before(cutoff) {
+			expired = append(expired, clientId)
+		}
+	}
+
+	for _, clientId := range expired {
+		delete(this.lastSeen, clientId)
+		delete(this.subs, clientId)
+		delete(this.offline, clientId)
+		delete(this.inflight, clientId)
+	}
+	return expired, nil
+}
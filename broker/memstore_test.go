@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/funkygao/mhub/config"
+	proto "github.com/funkygao/mqttmsg"
+)
+
+func TestMemStoreEnqueueOfflineDiscardsOldest(t *testing.T) {
+	s := newMemStore()
+
+	for i := 0; i < 3; i++ {
+		m := &proto.Publish{MessageId: uint16(i + 1), TopicName: "a/b"}
+		if err := s.EnqueueOffline("client1", m, 2, config.BufferOverflowDiscard); err != nil {
+			t.Fatalf("EnqueueOffline #%d: %s", i, err)
+		}
+	}
+
+	queued, err := s.DrainOffline("client1")
+	if err != nil {
+		t.Fatalf("DrainOffline: %s", err)
+	}
+	if len(queued) != 2 {
+		t.Fatalf("DrainOffline returned %d messages, want 2 (oldest dropped)", len(queued))
+	}
+	if queued[0].MessageId != 2 || queued[1].MessageId != 3 {
+		t.Fatalf("DrainOffline = %+v, want MessageIds [2, 3]", queued)
+	}
+}
+
+func TestMemStoreEnqueueOfflineBlockReturnsErrWhenFull(t *testing.T) {
+	s := newMemStore()
+	m := &proto.Publish{MessageId: 1, TopicName: "a/b"}
+
+	if err := s.EnqueueOffline("client1", m, 1, config.BufferOverflowBlock); err != nil {
+		t.Fatalf("EnqueueOffline #1: %s", err)
+	}
+	if err := s.EnqueueOffline("client1", m, 1, config.BufferOverflowBlock); err != errOfflineQueueFull {
+		t.Fatalf("EnqueueOffline #2 = %v, want errOfflineQueueFull", err)
+	}
+}
+
+func TestMemStoreMatchSubscribers(t *testing.T) {
+	s := newMemStore()
+	s.SaveSubscription("client1", "a/+/c")
+	s.SaveSubscription("client2", "x/y")
+
+	got, err := s.MatchSubscribers("a/b/c")
+	if err != nil {
+		t.Fatalf("MatchSubscribers: %s", err)
+	}
+	if len(got) != 1 || got[0] != "client1" {
+		t.Fatalf("MatchSubscribers(a/b/c) = %v, want [client1]", got)
+	}
+}
+
+func TestMemStoreExpireSessions(t *testing.T) {
+	s := newMemStore()
+	s.Touch("stale")
+	s.lastSeen["stale"] = time.Now().Add(-2 * time.Hour)
+	s.Touch("fresh")
+
+	expired, err := s.ExpireSessions(time.Hour)
+	if err != nil {
+		t.Fatalf("ExpireSessions: %s", err)
+	}
+	if len(expired) != 1 || expired[0] != "stale" {
+		t.Fatalf("ExpireSessions = %v, want [stale]", expired)
+	}
+	if _, present := s.lastSeen["fresh"]; !present {
+		t.Fatal("fresh session should still be present")
+	}
+}
@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"net/http"
+
+	log "github.com/funkygao/log4go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus collectors for everything outboundLoop and the publish path
+// already tracked informally via server.stats and the slow-client log
+// line, now exported so operators can alarm on them instead of grepping
+// logs.
+var (
+	// topic and client_id are both user/device-controlled and unbounded
+	// (often one topic or client per device), so neither is safe as a
+	// Prometheus label: labeling on either would let a single noisy
+	// tenant explode the series cardinality for every broker exporting
+	// these metrics. Track plain totals instead.
+	publishedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mhub",
+		Name:      "published_total",
+		Help:      "PUBLISH messages accepted from clients.",
+	})
+
+	inflightDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mhub",
+		Name:      "inflight_depth",
+		Help:      "QoS>=1 messages currently awaiting acknowledgement across all sessions.",
+	})
+
+	queueFullDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mhub",
+		Name:      "queue_full_drops_total",
+		Help:      "Messages dropped because a client's outbound queue was full (BufferOverflowDiscard).",
+	})
+
+	writeLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mhub",
+		Name:      "client_write_latency_seconds",
+		Help:      "Time to encode and write a single message to a client socket.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	slowClientsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mhub",
+		Name:      "slow_clients_total",
+		Help:      "Writes that exceeded Broker.ClientSlowThreshold.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(publishedTotal, inflightDepth,
+		queueFullDrops, writeLatency, slowClientsTotal)
+}
+
+// ServeAdmin exposes /metrics (Prometheus) and /events (the JSON event
+// stream from events.go) on a dedicated admin listener, kept separate
+// from the MQTT listeners so operators can restrict access to it.
+func (this *Server) ServeAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/events", this.events.serveWS)
+
+	log.Info("admin endpoint listening on %s (/metrics, /events)", addr)
+	return http.ListenAndServe(addr, mux)
+}
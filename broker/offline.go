@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"time"
+
+	log "github.com/funkygao/log4go"
+)
+
+// SweepExpiredSessions runs until stop is closed, periodically dropping
+// any CleanSession=false session that has been disconnected longer than
+// ttl: its subscriptions, in-flight window, and offline queue are all
+// forgotten, and a client reconnecting afterwards is treated as new.
+func (this *Server) SweepExpiredSessions(ttl, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := this.store.ExpireSessions(ttl)
+			if err != nil {
+				log.Error("session-expiry sweep: %s", err)
+				continue
+			}
+
+			for _, clientId := range expired {
+				log.Info("session-expiry: dropping stale session %s", clientId)
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+
+	proto "github.com/funkygao/mqttmsg"
+	bolt "go.etcd.io/bbolt"
+)
+
+func encodeRetained(m *proto.Publish) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRetained(buf []byte) (*proto.Publish, error) {
+	var m proto.Publish
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RetainStore persists the single current retained message per topic. A
+// PUBLISH with Retain set and an empty payload is a tombstone: it clears
+// whatever was retained on that topic rather than storing an empty one,
+// per the MQTT spec.
+type RetainStore interface {
+	Set(m *proto.Publish) error
+	Delete(topic string) error
+	Match(filter string) []*proto.Publish
+	Close()
+}
+
+// memRetainStore is the default RetainStore: retained messages live only
+// in process memory, so they do not survive a broker restart.
+type memRetainStore struct {
+	mu   sync.RWMutex
+	msgs map[string]*proto.Publish
+}
+
+func newMemRetainStore() *memRetainStore {
+	return &memRetainStore{msgs: make(map[string]*proto.Publish)}
+}
+
+func (this *memRetainStore) Set(m *proto.Publish) error {
+	this.mu.Lock()
+	this.msgs[m.TopicName] = m
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *memRetainStore) Delete(topic string) error {
+	this.mu.Lock()
+	delete(this.msgs, topic)
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *memRetainStore) Match(filter string) []*proto.Publish {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var r []*proto.Publish
+	for topic, m := range this.msgs {
+		if topicMatches(filter, topic) {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+func (this *memRetainStore) Close() {}
+
+// boltRetainStore persists retained messages to a bbolt database so they
+// survive a broker restart, at the cost of one disk write per retained
+// PUBLISH.
+type boltRetainStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+var retainBucket = []byte("retained")
+
+func newBoltRetainStore(path string) (*boltRetainStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(retainBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltRetainStore{db: db, bucket: retainBucket}, nil
+}
+
+func (this *boltRetainStore) Set(m *proto.Publish) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		buf, err := encodeRetained(m)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(this.bucket).Put([]byte(m.TopicName), buf)
+	})
+}
+
+func (this *boltRetainStore) Delete(topic string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(this.bucket).Delete([]byte(topic))
+	})
+}
+
+func (this *boltRetainStore) Match(filter string) []*proto.Publish {
+	var r []*proto.Publish
+
+	this.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(this.bucket).Cursor()
+		for topic, buf := c.First(); topic != nil; topic, buf = c.Next() {
+			if !topicMatches(filter, string(topic)) {
+				continue
+			}
+
+			m, err := decodeRetained(buf)
+			if err != nil {
+				continue
+			}
+			r = append(r, m)
+		}
+		return nil
+	})
+
+	return r
+}
+
+func (this *boltRetainStore) Close() {
+	this.db.Close()
+}
@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"crypto/x509"
 	log "github.com/funkygao/log4go"
 	"github.com/funkygao/mhub/config"
 	proto "github.com/funkygao/mqttmsg"
@@ -23,6 +24,14 @@ type incomingConn struct {
 	heartbeatStop chan struct{}
 	store         Store
 	lastOpTime    int64 // // Last Unix timestamp when recieved message from this conn
+
+	inflight *inflightTable // QoS>=1 messages awaiting PUBACK/PUBREC/PUBREL/PUBCOMP
+
+	peerCert *x509.Certificate // set when this conn came in over a mutual-TLS listener
+
+	clean bool // true once the client sends its own DISCONNECT; suppresses the Will
+
+	onClose func() // if set, called once outboundLoop's defer tears the connection down
 }
 
 func (this *incomingConn) String() string {
@@ -57,13 +66,17 @@ func (this *incomingConn) heartbeat(keepAliveTimer time.Duration) {
 
 				this.server.stats.aborted()
 
-				if this.flag != nil && this.flag.WillFlag {
-					// TODO broker will publish a message on behalf of the client
-				}
-
 				return
 			}
 
+			// a session.go-only Touch at connect/disconnect isn't enough: a
+			// long-lived connection must keep refreshing its own last-seen
+			// time, or SweepExpiredSessions will delete its still-in-use
+			// durable state out from under it.
+			if this.flag != nil {
+				this.store.Touch(this.flag.ClientId)
+			}
+
 		case <-this.heartbeatStop:
 			return
 		}
@@ -103,6 +116,14 @@ func (this *incomingConn) submit(m proto.Message) {
 		return
 	}
 
+	if pub, ok := m.(*proto.Publish); ok && pub.Header.QosLevel != proto.QosAtMostOnce &&
+		this.inflight != nil {
+		if _, present := this.inflight.get(pub.MessageId); !present {
+			this.inflight.add(pub, inflightOutbound)
+			this.store.SaveInflight(this.flag.ClientId, pub)
+		}
+	}
+
 	if this.server.cf.Broker.BuffOverflowStrategy == config.BufferOverflowBlock {
 		this.jobs <- job{m: m}
 		return
@@ -114,6 +135,7 @@ func (this *incomingConn) submit(m proto.Message) {
 	default:
 		log.Debug("client[%s]: outbound(%d) full, discard %T", this,
 			len(this.jobs), m)
+		queueFullDrops.Inc()
 	}
 }
 
@@ -131,6 +153,18 @@ func (this *incomingConn) submitSync(m proto.Message) receipt {
 func (this *incomingConn) inboundLoop() {
 	defer func() {
 		this.server.stats.clientDisconnect()
+
+		if !this.clean && this.flag != nil && this.flag.WillFlag {
+			this.publishWill()
+		}
+
+		if this.flag != nil {
+			// mark the session's last-seen time so the session-expiry
+			// sweeper can tell how long it has been sitting offline
+			this.store.Touch(this.flag.ClientId)
+			this.server.events.disconnected(this.flag.ClientId)
+		}
+
 		this.store.Close()
 
 		this.alive = false // to avoid send on closed channel subs.c.submit FIXME
@@ -173,6 +207,7 @@ func (this *incomingConn) inboundLoop() {
 			// connect ok
 			log.Debug("new client: %s (c^%v, k^%v)",
 				this, m.CleanSession, m.KeepAliveTimer)
+			this.server.events.connected(this.flag.ClientId)
 
 		case *proto.Publish:
 			this.doPublish(m)
@@ -186,13 +221,25 @@ func (this *incomingConn) inboundLoop() {
 		case *proto.PubAck:
 			this.doPublishAck(m)
 
+		case *proto.PubRec:
+			this.doPubRec(m)
+
+		case *proto.PubRel:
+			this.doPubRel(m)
+
+		case *proto.PubComp:
+			this.doPubComp(m)
+
 		case *proto.PingReq:
 			// broker will never ping client
-			this.validateMessage(m)
+			if !this.validateMessage(m) {
+				return
+			}
 			this.submit(&proto.PingResp{})
 
 		case *proto.Disconnect:
 			log.Debug("%s actively disconnect", this)
+			this.clean = true
 			return
 
 		default:
@@ -213,6 +260,10 @@ func (this *incomingConn) outboundLoop() {
 
 		this.del()
 		this.server.subs.unsubAll(this)
+
+		if this.onClose != nil {
+			this.onClose()
+		}
 	}()
 
 	var (
@@ -256,9 +307,12 @@ func (this *incomingConn) outboundLoop() {
 				return
 			}
 
+			writeLatency.Observe(elapsed.Seconds())
+
 			totalN++
 			if elapsed.Nanoseconds() > this.server.cf.Broker.ClientSlowThreshold.Nanoseconds() {
 				slowN++
+				slowClientsTotal.Inc()
 				log.Warn("Slow client[%s] %d/%d, %s", this, slowN, totalN, elapsed)
 			}
 
@@ -274,9 +328,20 @@ func (this *incomingConn) outboundLoop() {
 
 }
 
-// TODO
-func (this *incomingConn) validateMessage(m proto.Message) {
-	// must CONNECT before other methods
+// validateMessage enforces MQTT 3.1.1 3.1: CONNECT must be the first
+// packet a client sends. this.flag and this.inflight are both set up
+// only inside doConnect, so any other packet arriving before it would
+// otherwise reach into nil session state (e.g. a nil *inflightTable's
+// mutex-guarded methods panic, killing the whole broker process, not
+// just this connection). Callers must bail out without touching
+// session state when this returns false.
+func (this *incomingConn) validateMessage(m proto.Message) bool {
+	if this.connected() {
+		return true
+	}
+
+	log.Warn("%s: %T before CONNECT, dropping", this, m)
+	return false
 }
 
 // TODO
@@ -301,12 +366,16 @@ func (this *incomingConn) doConnect(m *proto.Connect) (rc proto.ReturnCode) {
 	}
 	this.flag = m // connection flag
 
-	// authentication
-	if !this.server.cf.Broker.AllowAnonymousConnect &&
+	// authentication: a verified client certificate from a mutual-TLS
+	// listener stands in for username/password entirely.
+	if this.peerCert != nil {
+		log.Debug("%s authenticated via client cert %s", this, this.peerCert.Subject)
+	} else if !this.server.cf.Broker.AllowAnonymousConnect &&
 		(!m.UsernameFlag || m.Username == "" ||
 			!m.PasswordFlag || m.Password == "") {
 		rc = proto.RetCodeNotAuthorized
-	} else if m.UsernameFlag && !this.authenticate(m.Username, m.Password) {
+	} else if m.UsernameFlag && this.server.auth != nil &&
+		!this.server.auth.Authenticate(m.Username, m.Password) {
 		rc = proto.RetCodeBadUsernameOrPassword
 	}
 
@@ -331,34 +400,118 @@ func (this *incomingConn) doConnect(m *proto.Connect) (rc proto.ReturnCode) {
 		go this.heartbeat(time.Duration(m.KeepAliveTimer) * time.Second)
 	}
 
-	// TODO: Last will
-	// The will option allows clients to prepare for the worst.
+	this.inflight = newInflightTable()
+	go this.retryLoop()
+
+	this.store.Touch(this.flag.ClientId)
+
+	// CONNACK must be the first packet the client sees after CONNECT
+	// (MQTT 3.1.1 3.2); restoring subscriptions/offline queue and
+	// redelivering in-flight messages must happen after, not before.
+	this.submit(&proto.ConnAck{ReturnCode: rc})
+
+	// The will option allows clients to prepare for the worst: if this
+	// connection later goes away without a clean DISCONNECT, inboundLoop's
+	// deferred cleanup calls publishWill to honor it.
 	if !m.CleanSession {
 		// broker will keep the subscription active even after the client disconnects
 		// It will also queue any new messages it receives for the client, but
 		// only if they have QoS>0
-		// restore client's subscriptions
-		// deliver flying messages TODO
-		// deliver on connect
+		this.restoreSession()
 	}
 
-	this.submit(&proto.ConnAck{ReturnCode: rc})
-
 	return
 }
 
+// restoreSession re-establishes a CleanSession=false client's prior
+// subscriptions, redelivers whatever was already durably in-flight from
+// before this reconnect, and then replays whatever was queued for it
+// while it was offline.
+func (this *incomingConn) restoreSession() {
+	topics, err := this.store.LoadSubscriptions(this.flag.ClientId)
+	if err != nil {
+		log.Error("%s: load subscriptions: %s", this, err)
+	}
+	for _, topic := range topics {
+		this.server.subs.add(topic, this)
+	}
+
+	// Redeliver whatever was already durably in-flight from before this
+	// reconnect first: redeliverInflight's LoadInflight must read the
+	// store before the offline-queue drain below writes fresh entries
+	// into that same store via submit()'s auto-tracking, or every
+	// offline-queued message would be loaded straight back out by
+	// LoadInflight and resent a second time on this same reconnect.
+	this.redeliverInflight()
+
+	queued, err := this.store.DrainOffline(this.flag.ClientId)
+	if err != nil {
+		log.Error("%s: drain offline queue: %s", this, err)
+		return
+	}
+
+	for _, m := range queued {
+		dup := *m
+		dup.Header.DupFlag = true
+		this.submit(&dup)
+	}
+}
+
+// publishWill delivers this connection's Last Will and Testament. Called
+// from inboundLoop's deferred cleanup whenever the connection ends
+// without the client sending its own DISCONNECT.
+func (this *incomingConn) publishWill() {
+	will := &proto.Publish{
+		Header:    proto.Header{QosLevel: this.flag.WillQos},
+		TopicName: this.flag.WillTopic,
+		Payload:   proto.BytesPayload(this.flag.WillMessage),
+		Retain:    this.flag.WillRetain,
+	}
+
+	log.Debug("%s: publishing will to %q", this, will.TopicName)
+	this.deliver(will)
+}
+
 func (this *incomingConn) doPublish(m *proto.Publish) {
-	this.validateMessage(m)
+	if !this.validateMessage(m) {
+		return
+	}
 
 	// TODO assert m.TopicName is not wildcard
 	persist_inbound(this.store, m)
 
-	// replicate message to all subscribers of this topic
-	this.server.subs.submit(m)
+	publishedTotal.Inc()
+	this.server.events.published(this.flag.ClientId, m.TopicName, uint8(m.Header.QosLevel))
 
-	// replication to peers
-	if isGlobalTopic(m.TopicName) {
-		this.server.peers.submit(m)
+	// MQTT gives a broker no way to tell a publisher its PUBLISH was
+	// rejected, so an unauthorized publish still gets its normal
+	// QoS acknowledgement; it is just never fanned out to subscribers.
+	authorized := this.server.acl == nil || this.server.acl.CanPublish(this.flag.ClientId, m.TopicName)
+	if !authorized {
+		this.server.stats.publishDenied()
+		log.Warn("%s: publish to %q denied by ACL", this, m.TopicName)
+	}
+
+	if m.Header.QosLevel == proto.QosExactlyOnce { // QoS 2
+		if m.MessageId == 0 {
+			log.Error("client[%s] invalid message id", this)
+		}
+
+		// hold the message back until PUBREL confirms the sender only
+		// meant to deliver it once; dedup a retransmitted PUBLISH by
+		// MessageId instead of forwarding it again.
+		if _, present := this.inflight.get(m.MessageId); !present {
+			this.inflight.add(m, inflightInbound)
+		}
+		if !authorized {
+			this.inflight.remove(m.MessageId)
+		}
+		this.submit(&proto.PubRec{MessageId: m.MessageId})
+		return
+	}
+
+	if authorized {
+		this.deliver(m)
 	}
 
 	// for QoS 0, we need do nothing
@@ -369,27 +522,139 @@ func (this *incomingConn) doPublish(m *proto.Publish) {
 
 		this.submit(&proto.PubAck{MessageId: m.MessageId})
 	}
+}
 
-	// retry-until-acknowledged
+// deliver fans a PUBLISH out to subscribers. Unclustered, it goes to
+// local subscribers and, for global topics, to peer nodes; clustered, it
+// goes to the nodes the ring assigns the topic to, local subscribers
+// included only when this node is one of them. Retained-message storage
+// happens here too, since it is
+// keyed off the same QosLevel-independent delivery path.
+func (this *incomingConn) deliver(m *proto.Publish) {
+	// retained messages live in clusterState (raft-replicated) when
+	// clustered, so every node converges on the same value for a topic;
+	// otherwise each node keeps its own local RetainStore.
+	retain := this.server.retain
+	if this.server.cluster != nil {
+		retain = this.server.cluster.retain
+	}
 
-	// if a PUBLISH not authorized, MQTT has no way of telling client about this
-	// it must always make a positive acknowledgement according to QoS
+	if this.server.cluster != nil {
+		// clustered mode: route to the nodes owning this topic's
+		// subscribers rather than broadcasting to the whole mesh.
+		nodeIds, local := this.server.cluster.route(m.TopicName)
+		if local {
+			this.server.subs.submit(m)
+		}
+		for _, nodeId := range nodeIds {
+			if nodeId != this.server.cluster.selfId {
+				this.server.peers.submitTo(nodeId, m)
+			}
+		}
+	} else {
+		this.server.subs.submit(m)
+
+		if isGlobalTopic(m.TopicName) {
+			this.server.peers.submit(m)
+		}
+	}
+
+	if m.Header.QosLevel != proto.QosAtMostOnce {
+		this.queueOffline(m)
+	}
+
+	if m.Retain && retain != nil {
+		bp, _ := m.Payload.(proto.BytesPayload)
+		if len(bp) == 0 {
+			// empty payload on a retained PUBLISH is a tombstone: clear
+			// whatever was retained on this topic, store nothing new.
+			retain.Delete(m.TopicName)
+		} else {
+			retain.Set(m)
+		}
+	}
+}
+
+// queueOffline persists m into the offline queue of every client whose
+// persisted subscriptions match its topic but who is not currently
+// connected to this node, so restoreSession's DrainOffline call delivers
+// it once that CleanSession=false client reconnects.
+func (this *incomingConn) queueOffline(m *proto.Publish) {
+	subscribers, err := this.store.MatchSubscribers(m.TopicName)
+	if err != nil {
+		log.Error("%s: match subscribers for %q: %s", this, m.TopicName, err)
+		return
+	}
 
-	if m.Retain {
+	maxSize := this.server.cf.Broker.OfflineQueueSize
+	overflow := this.server.cf.Broker.BuffOverflowStrategy
 
+	for _, clientId := range subscribers {
+		clientsMu.Lock()
+		_, online := clients[clientId]
+		clientsMu.Unlock()
+		if online {
+			continue
+		}
+
+		if err := this.store.EnqueueOffline(clientId, m, maxSize, overflow); err != nil {
+			log.Warn("%s: enqueue offline for %s: %s", this, clientId, err)
+		}
 	}
 }
 
+func (this *incomingConn) doPubRec(m *proto.PubRec) {
+	if !this.validateMessage(m) {
+		return
+	}
+
+	if _, present := this.inflight.get(m.MessageId); !present {
+		log.Debug("%s: PUBREC for unknown msg %d, ignored", this, m.MessageId)
+		return
+	}
+
+	this.inflight.markAwaitComp(m.MessageId)
+	this.submit(&proto.PubRel{MessageId: m.MessageId})
+}
+
+func (this *incomingConn) doPubRel(m *proto.PubRel) {
+	if !this.validateMessage(m) {
+		return
+	}
+
+	if im, present := this.inflight.get(m.MessageId); present && im.dir == inflightInbound {
+		this.deliver(im.msg)
+		this.inflight.remove(m.MessageId)
+	}
+
+	// PUBCOMP is sent even if the MessageId is unknown (e.g. the PUBLISH
+	// was already delivered by a previous, retried PUBREL), since the
+	// client is only waiting for the handshake to close.
+	this.submit(&proto.PubComp{MessageId: m.MessageId})
+}
+
+func (this *incomingConn) doPubComp(m *proto.PubComp) {
+	if !this.validateMessage(m) {
+		return
+	}
+
+	this.inflight.remove(m.MessageId)
+	this.store.RemoveInflight(this.flag.ClientId, m.MessageId)
+}
+
 func (this *incomingConn) doPublishAck(m *proto.PubAck) {
-	this.validateMessage(m)
+	if !this.validateMessage(m) {
+		return
+	}
 
-	// get flying messages for this client
-	// if not found, ignore this PubAck
-	// if found, mark this flying message
+	this.inflight.remove(m.MessageId)
+	this.store.RemoveInflight(this.flag.ClientId, m.MessageId)
 }
 
 func (this *incomingConn) doSubscribe(m *proto.Subscribe) {
-	this.validateMessage(m)
+	if !this.validateMessage(m) {
+		return
+	}
 
 	// The SUBSCRIBE message also specifies the QoS level at which the subscriber wants to receive published messages.
 
@@ -399,27 +664,65 @@ func (this *incomingConn) doSubscribe(m *proto.Subscribe) {
 	}
 	for i, tq := range m.Topics {
 		// TODO: Handle varying QoS correctly
-		this.server.subs.add(tq.Topic, this)
+		if this.server.acl != nil && !this.server.acl.CanSubscribe(this.flag.ClientId, tq.Topic) {
+			// per spec: an unauthorized subscribe still gets a SUBACK,
+			// just with the failure code, and is never added to server.subs.
+			suback.TopicsQos[i] = qosFailure
+			continue
+		}
 
+		this.server.subs.add(tq.Topic, this)
 		suback.TopicsQos[i] = proto.QosAtMostOnce
+
+		if !this.flag.CleanSession {
+			this.store.SaveSubscription(this.flag.ClientId, tq.Topic)
+		}
 	}
 	this.submit(suback)
 
 	// A server may start sending PUBLISH messages due to the subscription before the client receives the SUBACK message.
 
-	// Note that if a server implementation does not authorize a SUBSCRIBE request to be made by a client, it has no way of informing that client. It must therefore make a positive acknowledgement with a SUBACK, and the client will not be informed that it was not authorized to subscribe.
+	// Process retained messages for the topics that were actually authorized
+	for i, tq := range m.Topics {
+		if suback.TopicsQos[i] == qosFailure {
+			continue
+		}
+		this.sendRetained(tq.Topic)
+	}
+}
+
+// sendRetained delivers every retained message matching filter to this
+// newly subscribing client, per MQTT 3.1.1 3.8.4: a SUBSCRIBE must be
+// followed by the retained message on each matching topic, if any.
+// Retained messages live in clusterState (raft-replicated) when
+// clustered, otherwise in the node-local RetainStore, mirroring the
+// same selection deliver() uses when storing them.
+func (this *incomingConn) sendRetained(filter string) {
+	retain := this.server.retain
+	if this.server.cluster != nil {
+		retain = this.server.cluster.retain
+	}
+	if retain == nil {
+		return
+	}
 
-	// Process retained messages
-	for _, tq := range m.Topics {
-		this.server.subs.sendRetain(tq.Topic, this)
+	for _, m := range retain.Match(filter) {
+		dup := *m
+		this.submit(&dup)
 	}
 }
 
 func (this *incomingConn) doUnsubscribe(m *proto.Unsubscribe) {
-	this.validateMessage(m)
+	if !this.validateMessage(m) {
+		return
+	}
 
 	for _, t := range m.Topics {
 		this.server.subs.unsub(t, this)
+
+		if !this.flag.CleanSession {
+			this.store.RemoveSubscription(this.flag.ClientId, t)
+		}
 	}
 
 	this.submit(&proto.UnsubAck{MessageId: m.MessageId})
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/funkygao/mhub/config"
+	proto "github.com/funkygao/mqttmsg"
+)
+
+// errOfflineQueueFull is returned by EnqueueOffline when a client's
+// offline queue is full and the configured overflow strategy is
+// BufferOverflowBlock, mirroring incomingConn.submit's own two policies.
+var errOfflineQueueFull = errors.New("broker: offline queue full")
+
+// Store persists per-client protocol state so that QoS delivery
+// guarantees survive broker restarts. Implementations must be safe for
+// concurrent use by multiple sessions.
+type Store interface {
+	Close()
+
+	// SaveInflight durably records a QoS>=1 PUBLISH that has been sent
+	// but not yet fully acknowledged, so it can be redelivered with DUP
+	// set if the broker or the client goes away before the handshake
+	// completes.
+	SaveInflight(clientId string, m *proto.Publish) error
+
+	// RemoveInflight drops a message once its handshake (PUBACK, or
+	// PUBREC/PUBREL/PUBCOMP) has completed.
+	RemoveInflight(clientId string, messageId uint16) error
+
+	// LoadInflight returns the still-unacknowledged messages for a
+	// client. The order of the returned messages is not defined.
+	LoadInflight(clientId string) ([]*proto.Publish, error)
+
+	// SaveSubscription and RemoveSubscription track a CleanSession=false
+	// client's subscription set so it can be restored on reconnect.
+	SaveSubscription(clientId, topic string) error
+	RemoveSubscription(clientId, topic string) error
+	LoadSubscriptions(clientId string) ([]string, error)
+
+	// MatchSubscribers returns the clientIds of every client whose
+	// persisted subscription filters match topic, so the publish path
+	// can tell which CleanSession=false clients need topic queued into
+	// their offline queue while they are not connected.
+	MatchSubscribers(topic string) ([]string, error)
+
+	// EnqueueOffline persists a QoS>=1 PUBLISH for a client that is not
+	// currently connected. overflow mirrors config.Broker.BuffOverflowStrategy:
+	// block backends may reject the write once maxSize is reached,
+	// discard backends silently drop the oldest entry instead.
+	EnqueueOffline(clientId string, m *proto.Publish, maxSize int, overflow config.BufferOverflowStrategy) error
+
+	// DrainOffline returns and clears everything queued for clientId,
+	// oldest first, so it can be replayed into a freshly reconnected
+	// session ahead of new traffic.
+	DrainOffline(clientId string) ([]*proto.Publish, error)
+
+	// Touch records that clientId was just seen (connect, disconnect, or
+	// a keep-alive tick while connected),
+	// and ExpireSessions returns the ids of sessions idle longer than
+	// ttl so the broker can drop their state.
+	Touch(clientId string) error
+	ExpireSessions(ttl time.Duration) ([]string, error)
+}